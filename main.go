@@ -2,14 +2,36 @@ package main
 
 import (
 	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/coreos/go-systemd/activation"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/http2"
 )
 
 type Config struct {
@@ -17,19 +39,65 @@ type Config struct {
 		Http  string
 		Https string
 		Ssl   struct {
-			Key     string
-			Cert    string
-			Enabled bool
+			Key                 string
+			Cert                string
+			Enabled             bool
+			MinVersion          string
+			CipherSuites        []string
+			PreferServerCiphers bool
+			NextProtos          []string
+			ClientCAs           string
+		}
+		Acme struct {
+			Enabled      bool
+			Hosts        []string
+			Email        string
+			CacheDir     string
+			Staging      bool
+			DirectoryURL string
 		}
-		Hostname  string
-		Root      string
-		AccessLog string
-		Gzip      []string
+		Hostname        string
+		Root            string
+		AccessLog       string
+		Gzip            []string
+		Brotli          []string
+		Routes          []RouteConfig
+		ShutdownTimeout string
+		LogFormat       string
 	}
 }
 
+type RouteConfig struct {
+	Prefix            string
+	Root              string
+	RequireClientCert bool
+	AllowedCNs        []string
+	BasicAuth         *BasicAuthConfig
+}
+
+type BasicAuthConfig struct {
+	User  string
+	Realm string
+	Hash  string
+}
+
 var config *Config
 
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var cipherSuites = func() map[string]uint16 {
+	suites := make(map[string]uint16)
+	for _, c := range tls.CipherSuites() {
+		suites[c.Name] = c.ID
+	}
+	return suites
+}()
+
 func init() {
 	if f, err := os.OpenFile("config.json", 0, 0); err == nil {
 		config = new(Config)
@@ -45,15 +113,71 @@ type Handler struct {
 
 type SslHandler struct{}
 
+// Auth gates access to Routes by client certificate CN and/or HTTP basic
+// auth before falling through to Handler for everything else. Routes are
+// matched longest-prefix-first so a protected subtree can sit under the
+// public root without the root handler ever seeing those requests.
+type Auth struct {
+	Routes  []compiledRoute
+	Handler http.Handler
+}
+
+type compiledRoute struct {
+	RouteConfig
+	files http.Handler
+}
+
+// Log writes access log lines to whatever writer is currently stored in
+// writer. The indirection lets a SIGHUP handler swap in a freshly opened
+// file (log rotation) without racing requests that are mid-write. mu is
+// shared across every Log value backed by the same file (the main handler
+// and the HTTP->HTTPS redirect handler both log to AccessLog) so concurrent
+// requests can't interleave each other's line.
 type Log struct {
-	io.Writer
+	writer *atomic.Value
+	mu     *sync.Mutex
 
 	Path    string
 	Handler http.Handler
 }
 
+type writerBox struct {
+	io.Writer
+}
+
+func (l Log) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.writer.Load().(writerBox).Write(b)
+}
+
+func (l Log) reopen() error {
+	f, err := os.OpenFile(l.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	old := l.writer.Load().(writerBox)
+	l.writer.Store(writerBox{f})
+
+	if closer, ok := old.Writer.(io.Closer); ok {
+		closer.Close()
+	}
+	l.mu.Unlock()
+
+	return nil
+}
+
+// GZip serves pre-compressed .br/.gz sidecar files next to the requested
+// path when one exists, and only falls back to compressing on the fly when
+// it doesn't. GzipRe/BrotliRe each list the extensions eligible for that
+// encoding; Root is where sidecars are looked up (mirrors Httpd.Root).
 type GZip struct {
-	*regexp.Regexp
+	GzipRe   *regexp.Regexp
+	BrotliRe *regexp.Regexp
+	Root     string
 	http.Handler
 }
 
@@ -64,74 +188,552 @@ type Writer struct {
 	Bytes  int
 }
 
-type GzipWriter struct {
-	gz io.Writer
+// CompressWriter routes bytes written by the wrapped handler through a
+// compressor (gzip or brotli) instead of straight to the ResponseWriter, so
+// the compressor's own writes - the wire bytes - are what gets counted by
+// the enclosing Writer.
+type CompressWriter struct {
+	w io.Writer
 	http.ResponseWriter
 }
 
+// anyRouteRequiresClientCert reports whether at least one route gates on a
+// client certificate, which tells buildTLSConfig whether it can request
+// certs without requiring them (so a public root can coexist with a
+// protected subtree) or must keep demanding one from everybody.
+func anyRouteRequiresClientCert(routes []compiledRoute) bool {
+	for _, r := range routes {
+		if r.RequireClientCert {
+			return true
+		}
+	}
+
+	return false
+}
+
 func main() {
 	var writer io.Writer
 
-	if f, err := os.OpenFile(config.Httpd.AccessLog, os.O_CREATE|os.O_APPEND, 0); err == nil {
+	if f, err := os.OpenFile(config.Httpd.AccessLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err == nil {
 		writer = f
 	} else {
 		writer = os.Stdout
 	}
 
+	logWriter := &atomic.Value{}
+	logWriter.Store(writerBox{writer})
+	logMu := &sync.Mutex{}
+
+	routes := buildRoutes()
+
 	handler := Log{
-		Writer: writer,
+		writer: logWriter,
+		mu:     logMu,
 		Path:   config.Httpd.AccessLog,
 		Handler: GZip{
-			regexp.MustCompile("(?i)\\.(" + strings.Join(config.Httpd.Gzip, "|") + ")$"),
-			Handler{
-				http.FileServer(http.Dir(config.Httpd.Root)),
+			GzipRe:   compressionRegexp(config.Httpd.Gzip),
+			BrotliRe: compressionRegexp(config.Httpd.Brotli),
+			Root:     config.Httpd.Root,
+			Handler: Auth{
+				Routes: routes,
+				Handler: Handler{
+					http.FileServer(http.Dir(config.Httpd.Root)),
+				},
 			},
 		},
 	}
 
+	listeners, err := activation.Listeners()
+	if err != nil {
+		listeners = nil
+	}
+
+	var servers []*http.Server
+
 	if config.Httpd.Ssl.Enabled {
-		go func() {
-			http.ListenAndServeTLS(config.Httpd.Https, config.Httpd.Ssl.Cert, config.Httpd.Ssl.Key, handler)
-		}()
-		http.ListenAndServe(config.Httpd.Http, Log{
-			Writer: writer,
-			Path:    config.Httpd.AccessLog,
-			Handler: SslHandler{},
-		})
+		redirect := Log{writer: logWriter, mu: logMu, Path: config.Httpd.AccessLog, Handler: SslHandler{}}
+		var httpHandler http.Handler = redirect
+		var tlsConfig *tls.Config
+
+		if config.Httpd.Acme.Enabled {
+			m := &autocert.Manager{
+				Prompt:     autocert.AcceptTOS,
+				HostPolicy: acmeHostPolicy(),
+				Cache:      autocert.DirCache(config.Httpd.Acme.CacheDir),
+				Email:      config.Httpd.Acme.Email,
+			}
+
+			if config.Httpd.Acme.Staging {
+				m.Client = &acme.Client{DirectoryURL: "https://acme-staging-v02.api.letsencrypt.org/directory"}
+			}
+
+			if config.Httpd.Acme.DirectoryURL != "" {
+				m.Client = &acme.Client{DirectoryURL: config.Httpd.Acme.DirectoryURL}
+			}
+
+			tlsConfig = buildTLSConfig(m.TLSConfig(), anyRouteRequiresClientCert(routes))
+			httpHandler = m.HTTPHandler(redirect)
+		} else {
+			tlsConfig = buildTLSConfig(nil, anyRouteRequiresClientCert(routes))
+		}
+
+		httpsSrv := &http.Server{Addr: config.Httpd.Https, Handler: handler, TLSConfig: tlsConfig}
+		http2.ConfigureServer(httpsSrv, nil)
+
+		httpSrv := &http.Server{Addr: config.Httpd.Http, Handler: httpHandler}
+
+		servers = append(servers, httpsSrv, httpSrv)
+
+		go serveTLS(httpsSrv, listenerAt(listeners, 1), config.Httpd.Ssl.Cert, config.Httpd.Ssl.Key)
+		go serve(httpSrv, listenerAt(listeners, 0))
 	} else {
-		http.ListenAndServe(config.Httpd.Http, handler)
+		httpSrv := &http.Server{Addr: config.Httpd.Http, Handler: handler}
+		servers = append(servers, httpSrv)
+
+		go serve(httpSrv, listenerAt(listeners, 0))
 	}
+
+	waitForSignal(servers, logWriter, logMu)
+}
+
+// listenerAt returns the systemd-activated listener at idx, or nil if the
+// process wasn't socket-activated (or didn't get that many sockets), in
+// which case the caller falls back to its own ListenAndServe[TLS].
+func listenerAt(listeners []net.Listener, idx int) net.Listener {
+	if idx < len(listeners) {
+		return listeners[idx]
+	}
+
+	return nil
+}
+
+func serve(srv *http.Server, l net.Listener) {
+	var err error
+	if l != nil {
+		err = srv.Serve(l)
+	} else {
+		err = srv.ListenAndServe()
+	}
+
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("httpd: %v", err)
+	}
+}
+
+func serveTLS(srv *http.Server, l net.Listener, certFile, keyFile string) {
+	var err error
+	if l != nil {
+		err = srv.ServeTLS(l, certFile, keyFile)
+	} else {
+		err = srv.ListenAndServeTLS(certFile, keyFile)
+	}
+
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("httpd: %v", err)
+	}
+}
+
+// waitForSignal blocks reopening the access log on SIGHUP, and drains the
+// servers on SIGTERM/SIGINT before returning so main can exit cleanly.
+func waitForSignal(servers []*http.Server, logWriter *atomic.Value, logMu *sync.Mutex) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	for s := range sig {
+		if s == syscall.SIGHUP {
+			if err := (Log{writer: logWriter, mu: logMu, Path: config.Httpd.AccessLog}).reopen(); err != nil {
+				log.Printf("httpd: reopening access log: %v", err)
+			}
+			continue
+		}
+
+		shutdown(servers)
+
+		return
+	}
+}
+
+func shutdown(servers []*http.Server) {
+	timeout := 15 * time.Second
+
+	if d := config.Httpd.ShutdownTimeout; d != "" {
+		if parsed, err := time.ParseDuration(d); err == nil {
+			timeout = parsed
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+
+		go func(s *http.Server) {
+			defer wg.Done()
+			s.Shutdown(ctx)
+		}(srv)
+	}
+
+	wg.Wait()
 }
 
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if strings.Index(r.Host, config.Httpd.Hostname) != -1 {
+	if hostAllowed(r.Host) {
 		h.files.ServeHTTP(w, r)
 	} else {
 		http.NotFound(w, r)
 	}
 }
 
-func (h GZip) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-		uri := r.RequestURI
+// compressionRegexp builds the "(?i)\.(a|b|c)$" matcher GZip uses to decide
+// which paths are eligible for a given encoding, or nil if exts is empty.
+func compressionRegexp(exts []string) *regexp.Regexp {
+	if len(exts) == 0 {
+		return nil
+	}
+
+	return regexp.MustCompile("(?i)\\.(" + strings.Join(exts, "|") + ")$")
+}
+
+// buildRoutes compiles Config.Httpd.Routes into matchable routes, longest
+// Prefix first, each serving its own Root via a dedicated file server. It
+// fails fast if a route asks for RequireClientCert without Ssl.ClientCAs
+// configured, since that combination silently never authenticates anyone
+// (the handshake never requests a client cert, so PeerCertificates is
+// always empty and every request to that route would 401).
+func buildRoutes() []compiledRoute {
+	routes := make([]compiledRoute, len(config.Httpd.Routes))
+
+	for i, rc := range config.Httpd.Routes {
+		if rc.RequireClientCert && config.Httpd.Ssl.ClientCAs == "" {
+			log.Fatalf("httpd: route %q sets RequireClientCert but Ssl.ClientCAs is not configured", rc.Prefix)
+		}
+
+		routes[i] = compiledRoute{
+			RouteConfig: rc,
+			files:       http.StripPrefix(rc.Prefix, http.FileServer(http.Dir(rc.Root))),
+		}
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		return len(routes[i].Prefix) > len(routes[j].Prefix)
+	})
+
+	return routes
+}
+
+func (a Auth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, route := range a.Routes {
+		if !strings.HasPrefix(r.URL.Path, route.Prefix) {
+			continue
+		}
 
-		if uri == "/" {
-			uri += "index.html"
+		if route.RequireClientCert {
+			if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+				http.Error(w, "client certificate required", http.StatusUnauthorized)
+				return
+			}
+
+			cn := r.TLS.PeerCertificates[0].Subject.CommonName
+			if !cnAllowed(cn, route.AllowedCNs) {
+				http.Error(w, "client certificate not authorized", http.StatusForbidden)
+				return
+			}
+		} else if route.BasicAuth != nil {
+			if !checkBasicAuth(r, route.BasicAuth) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", route.BasicAuth.Realm))
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
 		}
 
-		if h.Match([]byte(uri)) {
-			w.Header().Set("Content-Encoding", "gzip")
+		route.files.ServeHTTP(w, r)
+		return
+	}
 
-			gz := gzip.NewWriter(w)
-			defer gz.Close()
+	a.Handler.ServeHTTP(w, r)
+}
 
-			h.Handler.ServeHTTP(GzipWriter{gz: gz, ResponseWriter: w}, r)
+func cnAllowed(cn string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == cn {
+			return true
+		}
+	}
+
+	return false
+}
+
+func checkBasicAuth(r *http.Request, auth *BasicAuthConfig) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok || user != auth.User {
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(auth.Hash), []byte(pass)) == nil
+}
+
+// hostAllowed reports whether host matches one of the configured hostnames.
+// Acme.Hosts takes precedence; Httpd.Hostname is kept as a fallback so
+// single-host deployments that never set up Hosts keep working unchanged.
+// Matching is exact (after stripping any port), consistent with
+// acmeHostPolicy's map lookup - a substring match would let
+// "evil-example.com.attacker.net" through for Hostname "example.com".
+func hostAllowed(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	hosts := config.Httpd.Acme.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{config.Httpd.Hostname}
+	}
+
+	for _, h := range hosts {
+		if h == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// buildTLSConfig applies the configurable Httpd.Ssl parameters on top of base
+// (base may be nil, e.g. when there is no autocert manager in play) and fails
+// fast if the operator named a version or cipher suite we don't recognize.
+// requireClientCert should be the result of anyRouteRequiresClientCert: when
+// true, a client cert is requested but not mandatory at the handshake level
+// (Auth enforces it per-route instead), so a public root can sit alongside a
+// cert-gated subtree; when false, ClientCAs being set means the whole server
+// is meant to be cert-gated, so every connection must present one.
+func buildTLSConfig(base *tls.Config, requireClientCert bool) *tls.Config {
+	cfg := base
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+
+	if v := config.Httpd.Ssl.MinVersion; v != "" {
+		version, ok := tlsVersions[v]
+		if !ok {
+			log.Fatalf("httpd: unknown Ssl.MinVersion %q", v)
+		}
+		cfg.MinVersion = version
+	}
+
+	if len(config.Httpd.Ssl.CipherSuites) > 0 {
+		ids := make([]uint16, 0, len(config.Httpd.Ssl.CipherSuites))
+		for _, name := range config.Httpd.Ssl.CipherSuites {
+			id, ok := cipherSuites[name]
+			if !ok {
+				log.Fatalf("httpd: unknown Ssl.CipherSuites entry %q", name)
+			}
+			ids = append(ids, id)
+		}
+		cfg.CipherSuites = ids
+	}
+
+	cfg.PreferServerCipherSuites = config.Httpd.Ssl.PreferServerCiphers
+
+	if len(config.Httpd.Ssl.NextProtos) > 0 {
+		// Merge rather than replace: base may already carry protos the
+		// caller depends on (e.g. autocert's "acme-tls/1" for TLS-ALPN-01),
+		// and overwriting them would silently break issuance.
+		merged := append([]string{}, cfg.NextProtos...)
+		cfg.NextProtos = append(merged, config.Httpd.Ssl.NextProtos...)
+	}
+
+	if path := config.Httpd.Ssl.ClientCAs; path != "" {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatalf("httpd: reading Ssl.ClientCAs: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("httpd: no certificates found in Ssl.ClientCAs %q", path)
+		}
+
+		cfg.ClientCAs = pool
+
+		// Note: this also applies to the ACME-enabled server. If a route
+		// requires a client cert we only request-not-require one here so
+		// unauthenticated ACME TLS-ALPN-01 challenge connections still
+		// complete; otherwise (no route needs one) ClientCAs being set at
+		// all means the operator wants the entire server cert-gated, which
+		// will also reject ACME's own TLS-ALPN-01 challenge connections -
+		// don't combine a whole-server ClientCAs with Acme.Enabled. HTTP-01
+		// challenges are answered on the plain HTTP server and never go
+		// through this config.
+		if requireClientCert {
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		} else {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return cfg
+}
+
+// acmeHostPolicy builds an autocert.HostPolicy from the same host set used
+// by hostAllowed, so ACME only issues certificates for hosts we actually serve.
+func acmeHostPolicy() autocert.HostPolicy {
+	hosts := config.Httpd.Acme.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{config.Httpd.Hostname}
+	}
+
+	allowed := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		allowed[h] = true
+	}
+
+	return func(ctx context.Context, host string) error {
+		if allowed[host] {
+			return nil
+		}
+		return fmt.Errorf("acme/autocert: host %q not configured", host)
+	}
+}
+
+func (g GZip) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	uri := r.URL.Path
+	if uri == "/" {
+		uri += "index.html"
+	}
+
+	matchesGzip := g.GzipRe != nil && g.GzipRe.MatchString(uri)
+	matchesBrotli := g.BrotliRe != nil && g.BrotliRe.MatchString(uri)
+
+	if !matchesGzip && !matchesBrotli {
+		g.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	encs := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+
+	for _, enc := range encs {
+		switch {
+		case enc == "br" && matchesBrotli:
+			if g.serveSidecar(w, r, uri, ".br", "br") {
+				return
+			}
+
+		case enc == "gzip" && matchesGzip:
+			if g.serveSidecar(w, r, uri, ".gz", "gzip") {
+				return
+			}
+		}
+	}
+
+	for _, enc := range encs {
+		switch {
+		case enc == "br" && matchesBrotli:
+			g.serveCompressed(w, r, "br", func(w io.Writer) io.WriteCloser {
+				return brotli.NewWriter(w)
+			})
+
+			return
+
+		case enc == "gzip" && matchesGzip:
+			g.serveCompressed(w, r, "gzip", func(w io.Writer) io.WriteCloser {
+				return gzip.NewWriter(w)
+			})
 
 			return
 		}
 	}
 
-	h.Handler.ServeHTTP(w, r)
+	g.Handler.ServeHTTP(w, r)
+}
+
+// serveSidecar looks for root/uri+ext and, if present, serves it directly
+// with http.ServeContent (so Range/If-Modified-Since keep working) using
+// the original uncompressed file's name (for content-type sniffing) and
+// mtime (for conditional GETs).
+func (g GZip) serveSidecar(w http.ResponseWriter, r *http.Request, uri, ext, encoding string) bool {
+	origPath := filepath.Join(g.Root, filepath.Clean(uri))
+
+	sidecar, err := os.Open(origPath + ext)
+	if err != nil {
+		return false
+	}
+	defer sidecar.Close()
+
+	modTime := time.Time{}
+	if info, err := os.Stat(origPath); err == nil {
+		modTime = info.ModTime()
+	} else if info, err := sidecar.Stat(); err == nil {
+		modTime = info.ModTime()
+	}
+
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	http.ServeContent(w, r, uri, modTime, sidecar)
+
+	return true
+}
+
+// serveCompressed streams the response through newWriter (gzip or brotli),
+// wrapping w in CompressWriter so the wire bytes - not the uncompressed
+// payload - are what the enclosing Writer counts for the access log.
+func (g GZip) serveCompressed(w http.ResponseWriter, r *http.Request, encoding string, newWriter func(io.Writer) io.WriteCloser) {
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	cw := newWriter(w)
+	defer cw.Close()
+
+	g.Handler.ServeHTTP(CompressWriter{w: cw, ResponseWriter: w}, r)
+}
+
+// acceptedEncodings parses an Accept-Encoding header into encoding names
+// ordered by preference (higher q first), dropping anything with q=0.
+func acceptedEncodings(header string) []string {
+	type weighted struct {
+		name string
+		q    float64
+	}
+
+	var encs []weighted
+
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name := part
+		q := 1.0
+
+		if idx := strings.Index(part, ";"); idx != -1 {
+			name = strings.TrimSpace(part[:idx])
+
+			if qPart := strings.TrimSpace(part[idx+1:]); strings.HasPrefix(qPart, "q=") {
+				if v, err := strconv.ParseFloat(qPart[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		if q <= 0 {
+			continue
+		}
+
+		encs = append(encs, weighted{name, q})
+	}
+
+	sort.SliceStable(encs, func(i, j int) bool {
+		return encs[i].q > encs[j].q
+	})
+
+	names := make([]string, len(encs))
+	for i, e := range encs {
+		names[i] = e.name
+	}
+
+	return names
 }
 
 func (s SslHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -141,8 +743,76 @@ func (s SslHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, r.URL.String(), http.StatusMovedPermanently)
 }
 
+type contextKey string
+
+const requestIDContextKey contextKey = "requestID"
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, id)
+}
+
+// RequestIDFromContext returns the per-request ID Log generated (or copied
+// from an incoming X-Request-ID header), so other handlers in the chain -
+// the ACL/basic-auth layer, say - can log against the same ID.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+func generateRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+
+	return ""
+}
+
+// accessLogEntry is what Log writes out one-per-line when LogFormat is
+// "json". Field names mirror the combined-log-format equivalents.
+type accessLogEntry struct {
+	Time            string  `json:"time"`
+	RequestID       string  `json:"request_id"`
+	RemoteAddr      string  `json:"remote_addr"`
+	Method          string  `json:"method"`
+	URI             string  `json:"uri"`
+	Status          int     `json:"status"`
+	Bytes           int     `json:"bytes"`
+	Referer         string  `json:"referer"`
+	UserAgent       string  `json:"user_agent"`
+	TLSVersion      string  `json:"tls_version,omitempty"`
+	TLSCipherSuite  string  `json:"tls_cipher_suite,omitempty"`
+	ALPN            string  `json:"alpn,omitempty"`
+	ContentEncoding string  `json:"content_encoding,omitempty"`
+	DurationMs      float64 `json:"duration_ms"`
+}
+
 func (l Log) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rid := r.Header.Get("X-Request-ID")
+	if rid == "" {
+		rid = generateRequestID()
+	}
+	w.Header().Set("X-Request-ID", rid)
+
+	r = r.WithContext(withRequestID(r.Context(), rid))
+
 	lw := Writer{ResponseWriter: w}
+	start := time.Now()
 
 	defer func() {
 		var addr string
@@ -155,6 +825,34 @@ func (l Log) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		addr = strings.Trim(addr, "[]")
 
+		if config.Httpd.LogFormat == "json" {
+			entry := accessLogEntry{
+				Time:            time.Now().Format(time.RFC3339),
+				RequestID:       rid,
+				RemoteAddr:      addr,
+				Method:          r.Method,
+				URI:             r.RequestURI,
+				Status:          lw.Status,
+				Bytes:           lw.Bytes,
+				Referer:         r.Header.Get("referer"),
+				UserAgent:       r.UserAgent(),
+				ContentEncoding: lw.Header().Get("Content-Encoding"),
+				DurationMs:      float64(time.Since(start)) / float64(time.Millisecond),
+			}
+
+			if r.TLS != nil {
+				entry.TLSVersion = tlsVersionName(r.TLS.Version)
+				entry.TLSCipherSuite = tls.CipherSuiteName(r.TLS.CipherSuite)
+				entry.ALPN = r.TLS.NegotiatedProtocol
+			}
+
+			if b, err := json.Marshal(entry); err == nil {
+				l.Write(append(b, '\n'))
+			}
+
+			return
+		}
+
 		fmt.Fprintf(l, "%s [%s] %s \"%s\" %d %d \"%s\" \"%s\"\n",
 			addr,
 			time.Now().Format("02/Jan/2006 15:04:05 -0700"),
@@ -169,8 +867,8 @@ func (l Log) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	l.Handler.ServeHTTP(&lw, r)
 }
 
-func (w GzipWriter) Write(b []byte) (int, error) {
-	return w.gz.Write(b)
+func (w CompressWriter) Write(b []byte) (int, error) {
+	return w.w.Write(b)
 }
 
 func (w *Writer) Write(b []byte) (int, error) {